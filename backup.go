@@ -0,0 +1,246 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"lesiw.io/command"
+	"lesiw.io/k8s/secrets"
+)
+
+//go:embed backup.yml
+var backupCfg string
+
+// backupEncryptionKeyRef is where backup/restore look up the key used to
+// encrypt the exported secrets tarball.
+var backupEncryptionKeyRef = secrets.SecretRef("spkez://k8s/backup/encryption-key")
+
+// managedSecrets lists the tool-managed Kubernetes secrets a backup
+// exports, so a restore can recreate them without redriving every
+// component's secrets.Provider chain.
+var managedSecrets = []string{
+	"cert-manager-cloudflare-token",
+	"registry-auth-secret",
+	"regcred",
+}
+
+// weeklyBackupCron triggers the on-demand Backup CR written to
+// /etc/k8s/backup.yml by installBackupCron. It deliberately shells out to
+// kubectl rather than this tool's own binary, since only the former is
+// guaranteed to be present on the node.
+const weeklyBackupCron = `0 3 * * 0 root kubectl apply -f /etc/k8s/backup.yml >> ` +
+	`/var/log/k8s-backup.log 2>&1
+`
+
+// installBackupCron installs the weekly backup cron job on the cluster's
+// first server node, alongside the per-node autopatch cron managed by
+// installAutopatch.
+func installBackupCron(ctx context.Context) error {
+	cluster, err := loadCluster()
+	if err != nil {
+		return err
+	}
+	servers := cluster.Servers()
+	if len(servers) == 0 {
+		return fmt.Errorf("topology.yml: must define at least one server node")
+	}
+	node, err := getNode(servers[0].Name)
+	if err != nil {
+		return err
+	}
+	if err := node.WriteFile(ctx, "/etc/k8s/backup.yml", []byte(backupCfg)); err != nil {
+		return fmt.Errorf("could not install backup manifest: %w", err)
+	}
+	err = node.WriteFile(ctx, "/etc/cron.d/k8s-backup", []byte(weeklyBackupCron))
+	if err != nil {
+		return fmt.Errorf("could not install backup cron job: %w", err)
+	}
+	return nil
+}
+
+// backup triggers an on-demand CNPG Backup and exports the tool-managed
+// secrets as an encrypted tarball at path.
+func backup(ctx context.Context, path string) error {
+	ctl, err := getCtl()
+	if err != nil {
+		return err
+	}
+	_, err = command.Copy(
+		ctl.Command(ctx, "apply", "-f", "-"),
+		strings.NewReader(backupCfg),
+	)
+	if err != nil {
+		return fmt.Errorf("could not create postgres backup: %w", err)
+	}
+	if err := exportSecrets(ctx, ctl, path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// restore recreates the tool-managed secrets from the tarball at path,
+// then creates a bootstrap postgres Cluster that recovers from source,
+// the name of the CNPG Backup to recover from.
+func restore(ctx context.Context, source, path string) error {
+	if source == "" {
+		return fmt.Errorf("restore: backup name required, e.g. k8s restore <backup-name>")
+	}
+	ctl, err := getCtl()
+	if err != nil {
+		return err
+	}
+	if err := importSecrets(ctx, ctl, path); err != nil {
+		return err
+	}
+	cr := fmt.Sprintf(restoreClusterCfg, source)
+	_, err = command.Copy(
+		ctl.Command(ctx, "apply", "-f", "-"),
+		strings.NewReader(cr),
+	)
+	if err != nil {
+		return fmt.Errorf("could not create recovery cluster: %w", err)
+	}
+	return nil
+}
+
+const restoreClusterCfg = `apiVersion: postgresql.cnpg.io/v1
+kind: Cluster
+metadata:
+  name: postgres
+spec:
+  instances: 3
+  bootstrap:
+    recovery:
+      source: %s
+`
+
+// exportSecrets gathers managedSecrets from the cluster into a gzipped
+// tar, encrypted under backupEncryptionKeyRef, and writes it to path.
+func exportSecrets(ctx context.Context, ctl command.Machine, path string) error {
+	key, err := backupEncryptionKeyRef.Resolve(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get backup encryption key: %w", err)
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range managedSecrets {
+		out, err := command.Call(ctx, ctl, "get", "secret", name, "-o", "json")
+		if err != nil {
+			return fmt.Errorf("could not read secret %s: %w", name, err)
+		}
+		hdr := &tar.Header{Name: name + ".json", Size: int64(len(out)), Mode: 0600}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("could not write tar header for %s: %w", name, err)
+		}
+		if _, err := tw.Write([]byte(out)); err != nil {
+			return fmt.Errorf("could not write secret %s to tar: %w", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("could not finalize secrets tar: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("could not finalize secrets gzip: %w", err)
+	}
+	ciphertext, err := encrypt(buf.Bytes(), key)
+	if err != nil {
+		return fmt.Errorf("could not encrypt secrets backup: %w", err)
+	}
+	if err := os.WriteFile(path, ciphertext, 0600); err != nil {
+		return fmt.Errorf("could not write secrets backup to %s: %w", path, err)
+	}
+	return nil
+}
+
+// importSecrets decrypts a tarball written by exportSecrets and applies
+// each secret back onto the cluster.
+func importSecrets(ctx context.Context, ctl command.Machine, path string) error {
+	key, err := backupEncryptionKeyRef.Resolve(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get backup encryption key: %w", err)
+	}
+	ciphertext, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read secrets backup %s: %w", path, err)
+	}
+	plaintext, err := decrypt(ciphertext, key)
+	if err != nil {
+		return fmt.Errorf("could not decrypt secrets backup: %w", err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return fmt.Errorf("could not read secrets backup: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read secrets backup entry: %w", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("could not read %s from secrets backup: %w", hdr.Name, err)
+		}
+		_, err = command.Copy(
+			ctl.Command(ctx, "apply", "-f", "-"),
+			bytes.NewReader(data),
+		)
+		if err != nil {
+			return fmt.Errorf("could not restore %s: %w", hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+const aesNonceSize = 12
+
+// encrypt seals plaintext with AES-GCM under a key derived from
+// passphrase, prefixing the result with the nonce.
+func encrypt(plaintext []byte, passphrase string) ([]byte, error) {
+	gcm, err := newGCM(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aesNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decrypt reverses encrypt.
+func decrypt(ciphertext []byte, passphrase string) ([]byte, error) {
+	gcm, err := newGCM(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aesNonceSize {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, data := ciphertext[:aesNonceSize], ciphertext[aesNonceSize:]
+	return gcm.Open(nil, nonce, data, nil)
+}
+
+func newGCM(passphrase string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"lesiw.io/command"
+	"lesiw.io/command/sub"
+	"lesiw.io/command/sys"
+	"lesiw.io/defers"
+	"lesiw.io/k8s/secrets"
+)
+
+//go:embed topology.yml
+var topologyCfg string
+
+// NodeRole is a k3s node's role within the cluster.
+type NodeRole string
+
+const (
+	RoleServer NodeRole = "server"
+	RoleAgent  NodeRole = "agent"
+)
+
+// Node is a single host in the cluster, addressed over SSH by Name.
+type Node struct {
+	Name string
+	Role NodeRole
+}
+
+// Cluster is the set of nodes this tool manages.
+type Cluster struct {
+	Nodes []Node
+}
+
+// Servers returns the cluster's server nodes, in topology.yml order. The
+// first server bootstraps the k3s cluster; the rest join it.
+func (c Cluster) Servers() []Node {
+	var nodes []Node
+	for _, n := range c.Nodes {
+		if n.Role == RoleServer {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// Agents returns the cluster's agent nodes.
+func (c Cluster) Agents() []Node {
+	var nodes []Node
+	for _, n := range c.Nodes {
+		if n.Role == RoleAgent {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// loadCluster parses topology.yml, which lists this tool's nodes.
+var loadCluster = sync.OnceValues(func() (Cluster, error) {
+	return parseCluster(topologyCfg)
+})
+
+// parseCluster understands the small subset of YAML topology.yml uses:
+//
+//	nodes:
+//	  - name: host
+//	    role: server
+func parseCluster(raw string) (Cluster, error) {
+	var c Cluster
+	var cur *Node
+	for _, line := range strings.Split(raw, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || trimmed == "nodes:":
+			continue
+		case strings.HasPrefix(trimmed, "- name:"):
+			if cur != nil {
+				c.Nodes = append(c.Nodes, *cur)
+			}
+			cur = &Node{Name: strings.TrimSpace(strings.TrimPrefix(trimmed, "- name:"))}
+		case strings.HasPrefix(trimmed, "role:"):
+			if cur == nil {
+				return Cluster{}, fmt.Errorf("topology.yml: role before name")
+			}
+			role := NodeRole(strings.TrimSpace(strings.TrimPrefix(trimmed, "role:")))
+			if role != RoleServer && role != RoleAgent {
+				return Cluster{}, fmt.Errorf("topology.yml: unknown role %q", role)
+			}
+			cur.Role = role
+		default:
+			return Cluster{}, fmt.Errorf("topology.yml: unrecognized line %q", line)
+		}
+	}
+	if cur != nil {
+		c.Nodes = append(c.Nodes, *cur)
+	}
+	if len(c.Nodes) == 0 {
+		return Cluster{}, fmt.Errorf("topology.yml: no nodes defined")
+	}
+	return c, nil
+}
+
+var nodeShells sync.Map // map[string]*command.Sh
+
+// localSSH returns a local shell set up to exec the system ssh binary.
+// getNode and tunnels each build their own ssh invocation against it.
+var localSSH = func() *command.Sh {
+	sh := command.Shell(sys.Machine())
+	sh.Handle("ssh", sh.Unshell())
+	return sh
+}
+
+// sshKeyRef is where getNode and OpenTunnel look up the cluster's SSH
+// private key.
+var sshKeyRef = secrets.SecretRef("spkez://infra/ssh")
+
+// sshKeyPath writes the cluster's SSH private key to a temp file and
+// returns its path, for use as `ssh -i <path>`. The file is removed on
+// program exit.
+func sshKeyPath(ctx context.Context) (string, error) {
+	sshkey, err := sshKeyRef.Resolve(ctx)
+	if err != nil {
+		return "", fmt.Errorf("could not get ssh key: %w", err)
+	}
+	file, err := os.CreateTemp("", "sshkey")
+	if err != nil {
+		return "", fmt.Errorf("could not create temp file: %w", err)
+	}
+	defers.Add(func() { _ = os.Remove(file.Name()) })
+	defer file.Close()
+	if err := os.Chmod(file.Name(), 0600); err != nil {
+		return "", fmt.Errorf(
+			"could not set permissions on temp file: %w", err,
+		)
+	}
+	if _, err := file.WriteString(sshkey + "\n"); err != nil {
+		return "", fmt.Errorf("could not write to temp file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// getNode returns a shell connected to the named node over SSH, reusing
+// the connection on repeat calls for the same name.
+var getNode = func(name string) (*command.Sh, error) {
+	if v, ok := nodeShells.Load(name); ok {
+		return v.(*command.Sh), nil
+	}
+	ctx := context.Background()
+	sh := localSSH()
+
+	sshkeyPath, err := sshKeyPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	node := command.Shell(sub.Machine(sh, "ssh", "-i", sshkeyPath, name, "--"))
+	node.Handle("sh", node.Unshell())
+	node.Handle("curl", node.Unshell())
+	node.Handle("kubectl", node.Unshell())
+
+	nodeShells.Store(name, node)
+	return node, nil
+}
+
+// installK3s runs the k3s install script on host. env, if non-empty, is
+// prepended as inline shell variable assignments (e.g. "K3S_TOKEN=...
+// K3S_URL=..."); args are passed through to the k3s binary itself (e.g.
+// "server", "agent").
+func installK3s(ctx context.Context, host, env string, args ...string) error {
+	node, err := getNode(host)
+	if err != nil {
+		return err
+	}
+	if env == "" && len(args) == 0 {
+		_, err = command.Copy(
+			node.Command(ctx, "sh", "-s", "-"),
+			node.Command(ctx, "curl", "-sfL", "https://get.k3s.io"),
+		)
+	} else {
+		script := strings.TrimSpace(env + " sh -s - " + strings.Join(args, " "))
+		_, err = command.Copy(
+			node.Command(ctx, "sh", "-c", script),
+			node.Command(ctx, "curl", "-sfL", "https://get.k3s.io"),
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("could not install k3s on %s: %w", host, err)
+	}
+	return nil
+}
+
+// k3sToken reads the join token off a bootstrapped server node.
+func k3sToken(ctx context.Context, host string) (string, error) {
+	node, err := getNode(host)
+	if err != nil {
+		return "", err
+	}
+	token, err := node.ReadFile(ctx, "/var/lib/rancher/k3s/server/node-token")
+	if err != nil {
+		return "", fmt.Errorf("could not read k3s token from %s: %w", host, err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"lesiw.io/command"
+	"lesiw.io/k8s/secrets"
+)
+
+// annotate stamps a live object with the hash of the manifest just applied,
+// so the next Live() call can tell it's already up to date.
+func annotate(ctx context.Context, ctl command.Machine, kind, namespace, name, hash string) error {
+	args := []string{"annotate", kind, name, appliedHashAnnotation + "=" + hash, "--overwrite"}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	if err := command.Exec(ctx, ctl, args...); err != nil {
+		return fmt.Errorf("could not annotate %s/%s: %w", kind, name, err)
+	}
+	return nil
+}
+
+// k3s comes with traefik already installed; this component applies
+// configuration to the existing installation.
+type traefikComponent struct{}
+
+func (traefikComponent) Name() string { return "traefik" }
+
+func (traefikComponent) Desired(ctx context.Context) ([]Manifest, error) {
+	return []Manifest{
+		{Kind: "HelmChartConfig", Namespace: "kube-system", Name: "traefik",
+			Hash: manifestHash(traefikConfig)},
+	}, nil
+}
+
+func (traefikComponent) Live(ctx context.Context) ([]Manifest, error) {
+	ctl, err := getCtl()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := liveHash(ctx, ctl, "HelmChartConfig", "kube-system", "traefik")
+	if err != nil {
+		return nil, err
+	}
+	return []Manifest{
+		{Kind: "HelmChartConfig", Namespace: "kube-system", Name: "traefik", Hash: hash},
+	}, nil
+}
+
+func (traefikComponent) Reconcile(ctx context.Context, diff []Manifest) error {
+	ctl, err := getCtl()
+	if err != nil {
+		return err
+	}
+	_, err = command.Copy(
+		ctl.Command(ctx, "apply", "-f", "-"),
+		strings.NewReader(traefikConfig),
+	)
+	if err != nil {
+		return fmt.Errorf("could not configure traefik: %w", err)
+	}
+	return annotate(ctx, ctl, "HelmChartConfig", "kube-system", "traefik",
+		manifestHash(traefikConfig))
+}
+
+const cnpgURL = "https://raw.githubusercontent.com/cloudnative-pg/" +
+	"cloudnative-pg/release-1.25/releases/cnpg-1.25.0.yaml"
+
+// BarmanConfig points the postgres Cluster at an S3-compatible object
+// store for CNPG-managed backups. CredentialsRef must resolve to
+// "<accessKeyID>:<secretAccessKey>".
+type BarmanConfig struct {
+	DestinationPath string
+	EndpointURL     string
+	CredentialsRef  secrets.SecretRef
+}
+
+func (b BarmanConfig) credentials(ctx context.Context) (accessKeyID, secretAccessKey string, err error) {
+	r, err := b.CredentialsRef.Resolve(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	accessKeyID, secretAccessKey, ok := strings.Cut(r, ":")
+	if !ok {
+		return "", "", fmt.Errorf("credentials must be formatted accessKeyID:secretAccessKey")
+	}
+	return accessKeyID, secretAccessKey, nil
+}
+
+const barmanCredsCfg = `apiVersion: v1
+kind: Secret
+metadata:
+  name: postgres-backup-creds
+type: Opaque
+stringData:
+  ACCESS_KEY_ID: %s
+  ACCESS_SECRET_KEY: %s`
+
+const barmanBackupCfg = `
+  backup:
+    barmanObjectStore:
+      destinationPath: %s
+      endpointURL: %s
+      s3Credentials:
+        accessKeyId:
+          name: postgres-backup-creds
+          key: ACCESS_KEY_ID
+        secretAccessKey:
+          name: postgres-backup-creds
+          key: ACCESS_SECRET_KEY
+`
+
+const scheduledBackupCfg = `apiVersion: postgresql.cnpg.io/v1
+kind: ScheduledBackup
+metadata:
+  name: postgres-weekly
+spec:
+  schedule: "0 0 3 * * 0"
+  cluster:
+    name: postgres`
+
+// postgresComponent installs CNPG and a postgres Cluster. Barman, if set,
+// additionally configures the Cluster for S3-compatible object-store
+// backups and schedules a weekly ScheduledBackup alongside it.
+type postgresComponent struct {
+	Barman *BarmanConfig
+}
+
+func (postgresComponent) Name() string { return "postgres" }
+
+func (p postgresComponent) clusterCfg(ctx context.Context) (string, string, error) {
+	cfg := postgresClusterCfg
+	creds := ""
+	if p.Barman != nil {
+		accessKeyID, secretAccessKey, err := p.Barman.credentials(ctx)
+		if err != nil {
+			return "", "", fmt.Errorf("could not get barman credentials: %w", err)
+		}
+		creds = fmt.Sprintf(barmanCredsCfg, accessKeyID, secretAccessKey)
+		cfg += fmt.Sprintf(barmanBackupCfg, p.Barman.DestinationPath, p.Barman.EndpointURL)
+	}
+	return cfg, creds, nil
+}
+
+func (p postgresComponent) Desired(ctx context.Context) ([]Manifest, error) {
+	clusterCfg, creds, err := p.clusterCfg(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifests := []Manifest{
+		{Kind: "Deployment", Namespace: "cnpg-system", Name: "cnpg-controller-manager",
+			Hash: manifestHash(cnpgURL)},
+	}
+	if p.Barman != nil {
+		manifests = append(manifests,
+			Manifest{Kind: "Secret", Namespace: "default", Name: "postgres-backup-creds",
+				Hash: manifestHash(creds), Content: creds},
+			Manifest{Kind: "ScheduledBackup", Namespace: "default", Name: "postgres-weekly",
+				Hash: manifestHash(scheduledBackupCfg), Content: scheduledBackupCfg},
+		)
+	}
+	manifests = append(manifests, Manifest{Kind: "Cluster", Namespace: "default", Name: "postgres",
+		Hash: manifestHash(clusterCfg), Content: clusterCfg})
+	return manifests, nil
+}
+
+func (p postgresComponent) Live(ctx context.Context) ([]Manifest, error) {
+	ctl, err := getCtl()
+	if err != nil {
+		return nil, err
+	}
+	operatorHash, err := liveHash(ctx, ctl, "Deployment", "cnpg-system", "cnpg-controller-manager")
+	if err != nil {
+		return nil, err
+	}
+	manifests := []Manifest{
+		{Kind: "Deployment", Namespace: "cnpg-system", Name: "cnpg-controller-manager",
+			Hash: operatorHash},
+	}
+	if p.Barman != nil {
+		credsHash, err := liveHash(ctx, ctl, "Secret", "default", "postgres-backup-creds")
+		if err != nil {
+			return nil, err
+		}
+		scheduleHash, err := liveHash(ctx, ctl, "ScheduledBackup", "default", "postgres-weekly")
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests,
+			Manifest{Kind: "Secret", Namespace: "default", Name: "postgres-backup-creds", Hash: credsHash},
+			Manifest{Kind: "ScheduledBackup", Namespace: "default", Name: "postgres-weekly", Hash: scheduleHash},
+		)
+	}
+	clusterHash, err := liveHash(ctx, ctl, "Cluster", "default", "postgres")
+	if err != nil {
+		return nil, err
+	}
+	manifests = append(manifests, Manifest{Kind: "Cluster", Namespace: "default", Name: "postgres", Hash: clusterHash})
+	return manifests, nil
+}
+
+func (postgresComponent) Reconcile(ctx context.Context, diff []Manifest) error {
+	ctl, err := getCtl()
+	if err != nil {
+		return err
+	}
+	for _, m := range diff {
+		switch m.Name {
+		case "cnpg-controller-manager":
+			err = command.Exec(
+				ctx,
+				ctl,
+				"apply",
+				"--server-side",     // github.com/cloudnative-pg/charts/issues/325
+				"--force-conflicts", // necessary to install over existing versions
+				"-f",
+				cnpgURL,
+			)
+			if err != nil {
+				return fmt.Errorf("could not install CNPG: %w", err)
+			}
+			if err := annotate(ctx, ctl, m.Kind, m.Namespace, m.Name, m.Hash); err != nil {
+				return err
+			}
+		case "postgres-backup-creds", "postgres-weekly", "postgres":
+			_, err = command.Copy(
+				ctl.Command(ctx, "apply", "-f", "-"),
+				strings.NewReader(m.Content),
+			)
+			if err != nil {
+				return fmt.Errorf("could not apply %s: %w", m.Name, err)
+			}
+			if err := annotate(ctx, ctl, m.Kind, m.Namespace, m.Name, m.Hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const certManagerURL = "https://github.com/cert-manager/cert-manager/" +
+	"releases/download/v1.17.1/cert-manager.yaml"
+
+// defaultCloudflareRef is where the cert-manager component looks up the
+// Cloudflare API token when CloudflareRef isn't set.
+const defaultCloudflareRef = secrets.SecretRef("spkez://k8s/cert-manager/cloudflare")
+
+// certManagerComponent installs cert-manager and a cloudflare-dns01
+// ClusterIssuer. CloudflareRef lets callers point it at a different
+// secrets.Provider (e.g. "env://CF_TOKEN") instead of the default spkez ref.
+type certManagerComponent struct {
+	CloudflareRef secrets.SecretRef
+}
+
+func (certManagerComponent) Name() string { return "cert-manager" }
+
+func (c certManagerComponent) cloudflareRef() secrets.SecretRef {
+	if c.CloudflareRef != "" {
+		return c.CloudflareRef
+	}
+	return defaultCloudflareRef
+}
+
+func (c certManagerComponent) Desired(ctx context.Context) ([]Manifest, error) {
+	r, err := c.cloudflareRef().Resolve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get cloudflare API key: %w", err)
+	}
+	secret := fmt.Sprintf(secretCfg, "cert-manager-cloudflare-token", "api-token", r)
+	return []Manifest{
+		{Kind: "Deployment", Namespace: "cert-manager", Name: "cert-manager-webhook",
+			Hash: manifestHash(certManagerURL)},
+		{Kind: "Secret", Name: "cert-manager-cloudflare-token",
+			Hash: manifestHash(secret), Content: secret},
+		{Kind: "ClusterIssuer", Name: "cloudflare", Hash: manifestHash(issuerCfg)},
+	}, nil
+}
+
+func (certManagerComponent) Live(ctx context.Context) ([]Manifest, error) {
+	ctl, err := getCtl()
+	if err != nil {
+		return nil, err
+	}
+	controllerHash, err := liveHash(ctx, ctl, "Deployment", "cert-manager", "cert-manager-webhook")
+	if err != nil {
+		return nil, err
+	}
+	secretHash, err := liveHash(ctx, ctl, "Secret", "", "cert-manager-cloudflare-token")
+	if err != nil {
+		return nil, err
+	}
+	issuerHash, err := liveHash(ctx, ctl, "ClusterIssuer", "", "cloudflare")
+	if err != nil {
+		return nil, err
+	}
+	return []Manifest{
+		{Kind: "Deployment", Namespace: "cert-manager", Name: "cert-manager-webhook",
+			Hash: controllerHash},
+		{Kind: "Secret", Name: "cert-manager-cloudflare-token",
+			Hash: secretHash},
+		{Kind: "ClusterIssuer", Name: "cloudflare", Hash: issuerHash},
+	}, nil
+}
+
+func (certManagerComponent) Reconcile(ctx context.Context, diff []Manifest) error {
+	ctl, err := getCtl()
+	if err != nil {
+		return err
+	}
+	for _, m := range diff {
+		switch m.Name {
+		case "cert-manager-webhook":
+			err = command.Exec(ctx, ctl, "apply", "-f", certManagerURL)
+			if err != nil {
+				return fmt.Errorf("could not install cert-manager: %w", err)
+			}
+			if err := annotate(ctx, ctl, m.Kind, m.Namespace, m.Name, m.Hash); err != nil {
+				return err
+			}
+		case "cert-manager-cloudflare-token":
+			_, err = command.Copy(
+				ctl.Command(ctx, "apply", "-f", "-"),
+				strings.NewReader(m.Content),
+			)
+			if err != nil {
+				return fmt.Errorf("could not store cloudflare secret: %w", err)
+			}
+			if err := annotate(ctx, ctl, m.Kind, m.Namespace, m.Name, m.Hash); err != nil {
+				return err
+			}
+		case "cloudflare":
+			_, err = command.Copy(
+				ctl.Command(ctx, "apply", "-f", "-"),
+				strings.NewReader(issuerCfg),
+			)
+			if err != nil {
+				return fmt.Errorf("could not create cloudflare issuer: %w", err)
+			}
+			if err := annotate(ctx, ctl, m.Kind, m.Namespace, m.Name, m.Hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// defaultRegistryAuthRef is where the container-registry component looks
+// up the registry password when RegistryAuthRef isn't set.
+const defaultRegistryAuthRef = secrets.SecretRef("spkez://ctr.lesiw.dev/auth")
+
+// containerRegistryComponent installs the container registry and its
+// auth secrets. RegistryAuthRef lets callers point it at a different
+// secrets.Provider instead of the default spkez ref.
+type containerRegistryComponent struct {
+	RegistryAuthRef secrets.SecretRef
+}
+
+func (containerRegistryComponent) Name() string { return "container-registry" }
+
+func (c containerRegistryComponent) registryAuthRef() secrets.SecretRef {
+	if c.RegistryAuthRef != "" {
+		return c.RegistryAuthRef
+	}
+	return defaultRegistryAuthRef
+}
+
+func (c containerRegistryComponent) Desired(ctx context.Context) ([]Manifest, error) {
+	r, err := c.registryAuthRef().Resolve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get registry auth secret: %w", err)
+	}
+	authSecret := fmt.Sprintf(basicAuthCfg, "registry-auth-secret", "ll", r)
+	regcred, err := dockerConfigJSON("ctr.lesiw.dev", "ll", r)
+	if err != nil {
+		return nil, fmt.Errorf("could not build registry credentials: %w", err)
+	}
+	regcredSecret := fmt.Sprintf(dockerConfigJSONCfg, "regcred", regcred)
+	return []Manifest{
+		{Kind: "Secret", Name: "registry-auth-secret",
+			Hash: manifestHash(authSecret), Content: authSecret},
+		{Kind: "Deployment", Name: "container-registry", Hash: manifestHash(registryCfg)},
+		{Kind: "Secret", Name: "regcred", Hash: manifestHash(regcredSecret), Content: regcredSecret},
+	}, nil
+}
+
+// dockerAuthEntry is one server's credentials within a dockerconfigjson.
+type dockerAuthEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+// dockerConfigJSON renders the base64-encoded .dockerconfigjson value a
+// kubernetes.io/dockerconfigjson Secret expects, for a single registry
+// server.
+func dockerConfigJSON(server, username, password string) (string, error) {
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	cfg := struct {
+		Auths map[string]dockerAuthEntry `json:"auths"`
+	}{
+		Auths: map[string]dockerAuthEntry{
+			server: {Username: username, Password: password, Auth: auth},
+		},
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal dockerconfigjson: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func (containerRegistryComponent) Live(ctx context.Context) ([]Manifest, error) {
+	ctl, err := getCtl()
+	if err != nil {
+		return nil, err
+	}
+	authHash, err := liveHash(ctx, ctl, "Secret", "", "registry-auth-secret")
+	if err != nil {
+		return nil, err
+	}
+	registryHash, err := liveHash(ctx, ctl, "Deployment", "", "container-registry")
+	if err != nil {
+		return nil, err
+	}
+	regcredHash, err := liveHash(ctx, ctl, "Secret", "", "regcred")
+	if err != nil {
+		return nil, err
+	}
+	return []Manifest{
+		{Kind: "Secret", Name: "registry-auth-secret", Hash: authHash},
+		{Kind: "Deployment", Name: "container-registry", Hash: registryHash},
+		{Kind: "Secret", Name: "regcred", Hash: regcredHash},
+	}, nil
+}
+
+func (containerRegistryComponent) Reconcile(ctx context.Context, diff []Manifest) error {
+	ctl, err := getCtl()
+	if err != nil {
+		return err
+	}
+	for _, m := range diff {
+		switch m.Name {
+		case "registry-auth-secret":
+			_, err = command.Copy(
+				ctl.Command(ctx, "apply", "-f", "-"),
+				strings.NewReader(m.Content),
+			)
+			if err != nil {
+				return fmt.Errorf("could not store registry auth secret: %w", err)
+			}
+			if err := annotate(ctx, ctl, m.Kind, m.Namespace, m.Name, m.Hash); err != nil {
+				return err
+			}
+		case "container-registry":
+			_, err = command.Copy(
+				ctl.Command(ctx, "apply", "-f", "-"),
+				strings.NewReader(registryCfg),
+			)
+			if err != nil {
+				return fmt.Errorf("could not install registry: %w", err)
+			}
+			if err := annotate(ctx, ctl, m.Kind, m.Namespace, m.Name, m.Hash); err != nil {
+				return err
+			}
+		case "regcred":
+			_, err = command.Copy(
+				ctl.Command(ctx, "apply", "-f", "-"),
+				strings.NewReader(m.Content),
+			)
+			if err != nil {
+				return fmt.Errorf("could not store registry secret: %w", err)
+			}
+			if err := annotate(ctx, ctl, m.Kind, m.Namespace, m.Name, m.Hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -3,11 +3,12 @@ package main
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"os"
-	"strings"
+	"os/signal"
+	"strconv"
 	"sync"
 
 	"lesiw.io/command"
@@ -15,9 +16,15 @@ import (
 	"lesiw.io/command/sys"
 	"lesiw.io/defers"
 	"lesiw.io/fs"
+	"lesiw.io/k8s/secrets"
 )
 
-const host = "k8s.lesiw.dev"
+func init() {
+	secrets.Register("spkez", secrets.SpkezProvider{
+		Machine: func() (command.Machine, error) { return getSpkez() },
+	})
+	secrets.Register("env", secrets.EnvProvider{})
+}
 
 var getSpkez = sync.OnceValues(func() (command.Machine, error) {
 	ctx := context.Background()
@@ -43,41 +50,18 @@ var getSpkez = sync.OnceValues(func() (command.Machine, error) {
 	return sub.Machine(sh, "spkez"), nil
 })
 
+// getK8s returns a shell on the cluster's first server node, the node
+// that runs the tool-managed Kubernetes workloads.
 var getK8s = sync.OnceValues(func() (*command.Sh, error) {
-	ctx := context.Background()
-	sh := command.Shell(sys.Machine())
-	sh.Handle("ssh", sh.Unshell())
-
-	spkez, err := getSpkez()
+	cluster, err := loadCluster()
 	if err != nil {
 		return nil, err
 	}
-
-	sshkey, err := command.Call(ctx, spkez, "get", "infra/ssh")
-	if err != nil {
-		return nil, fmt.Errorf("could not get ssh key: %w", err)
-	}
-	file, err := os.CreateTemp("", "sshkey")
-	if err != nil {
-		return nil, fmt.Errorf("could not create temp file: %w", err)
+	servers := cluster.Servers()
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("topology.yml: must define at least one server node")
 	}
-	defers.Add(func() { _ = os.Remove(file.Name()) })
-	defer file.Close()
-	if err := os.Chmod(file.Name(), 0600); err != nil {
-		return nil, fmt.Errorf(
-			"could not set permissions on temp file: %w", err,
-		)
-	}
-	if _, err := file.WriteString(sshkey + "\n"); err != nil {
-		return nil, fmt.Errorf("could not write to temp file: %w", err)
-	}
-	sshkeyPath := file.Name()
-
-	k8s := command.Shell(sub.Machine(sh, "ssh", "-i", sshkeyPath, host, "--"))
-	k8s.Handle("sh", k8s.Unshell())
-	k8s.Handle("curl", k8s.Unshell())
-	k8s.Handle("kubectl", k8s.Unshell())
-	return k8s, nil
+	return getNode(servers[0].Name)
 })
 
 var getCtl = sync.OnceValues(func() (command.Machine, error) {
@@ -98,133 +82,221 @@ func main() {
 	defer defers.Run()
 
 	verbose := flag.Bool("v", false, "enable verbose command tracing")
+	dryRun := flag.Bool("dry-run", false, "print the reconciliation plan instead of applying it")
+	out := flag.String("out", "secrets.tar.enc", "path to the backup/restore secrets tarball")
+	barmanDestination := flag.String("barman-destination", "",
+		"S3 destination path for CNPG Barman backups (e.g. s3://bucket/path); "+
+			"enables postgresComponent's Barman backup support")
+	barmanEndpoint := flag.String("barman-endpoint", "",
+		"S3-compatible endpoint URL for CNPG Barman backups")
+	barmanCredsRef := flag.String("barman-creds-ref", "",
+		"secrets ref for Barman credentials, formatted accessKeyID:secretAccessKey")
+	cloudflareRef := flag.String("cloudflare-ref", "",
+		"secrets ref for the cert-manager cloudflare API token "+
+			"(default \"\" spkez://k8s/cert-manager/cloudflare)")
+	registryRef := flag.String("registry-ref", "",
+		"secrets ref for the container registry password "+
+			"(default \"\" spkez://ctr.lesiw.dev/auth)")
 	flag.Parse()
 
 	if *verbose {
 		command.Trace = command.ShTrace
 	}
 
-	if err := run(context.Background()); err != nil {
+	var err error
+	switch flag.Arg(0) {
+	case "backup":
+		err = backup(context.Background(), *out)
+	case "restore":
+		err = restore(context.Background(), flag.Arg(1), *out)
+	case "tunnel":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		err = runTunnel(ctx, flag.Args()[1:])
+	default:
+		barman := barmanConfig(*barmanDestination, *barmanEndpoint, *barmanCredsRef)
+		err = run(context.Background(), *dryRun, barman,
+			secrets.SecretRef(*cloudflareRef), secrets.SecretRef(*registryRef))
+	}
+	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		defers.Exit(1)
 	}
 }
 
-func run(ctx context.Context) error {
+// runTunnel is the `k8s tunnel <svc> <remote-port> [namespace]` entry
+// point: it opens a Tunnel and blocks until ctx is canceled (e.g. by
+// Ctrl-C).
+func runTunnel(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("tunnel: usage: k8s tunnel <svc> <remote-port> [namespace]")
+	}
+	remotePort, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("tunnel: invalid remote port %q: %w", args[1], err)
+	}
+	namespace := "default"
+	if len(args) > 2 {
+		namespace = args[2]
+	}
+	t, err := OpenTunnel(ctx, args[0], namespace, remotePort)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	fmt.Printf("tunneling %s/%s -> %s\n", namespace, args[0], t.URL())
+	<-ctx.Done()
+	return nil
+}
+
+// barmanConfig builds a BarmanConfig from the -barman-* flags, or returns
+// nil if none were set, leaving postgresComponent's Barman backups disabled.
+func barmanConfig(destination, endpoint, credsRef string) *BarmanConfig {
+	if destination == "" && endpoint == "" && credsRef == "" {
+		return nil
+	}
+	return &BarmanConfig{
+		DestinationPath: destination,
+		EndpointURL:     endpoint,
+		CredentialsRef:  secrets.SecretRef(credsRef),
+	}
+}
+
+func run(
+	ctx context.Context,
+	dryRun bool,
+	barman *BarmanConfig,
+	cloudflareRef, registryRef secrets.SecretRef,
+) error {
 	if err := installAutopatch(ctx); err != nil {
 		return err
 	}
+	if err := installBackupCron(ctx); err != nil {
+		return err
+	}
 	if err := updateK3s(ctx); err != nil {
 		return fmt.Errorf("failed to install or update k3s: %w", err)
 	}
-	if err := setupTraefik(ctx); err != nil {
-		return fmt.Errorf("failed to set up traefik: %w", err)
+	engine := &Engine{DryRun: dryRun}
+	if err := engine.Run(ctx, traefikComponent{}); err != nil {
+		return err
 	}
-	if err := setupPostgres(ctx); err != nil {
-		return fmt.Errorf("failed to set up postgres: %w", err)
+
+	if err := engine.Run(ctx, postgresComponent{Barman: barman}); err != nil {
+		return err
+	}
+	if !dryRun {
+		if err := waitForPostgresReady(ctx); err != nil {
+			return err
+		}
 	}
-	if err := setupCertManager(ctx); err != nil {
-		return fmt.Errorf("failed to set up cert-manager: %w", err)
+
+	if err := engine.Run(ctx, certManagerComponent{CloudflareRef: cloudflareRef}); err != nil {
+		return err
 	}
-	if err := setupContainerRegistry(ctx); err != nil {
-		return fmt.Errorf("failed to setup container registry: %w", err)
+	if !dryRun {
+		if err := waitForCertManagerReady(ctx); err != nil {
+			return err
+		}
 	}
-	return nil
+
+	// containerRegistryComponent's Certificate races cert-manager's
+	// webhooks and the cloudflare ClusterIssuer if requested too early,
+	// hence the wait above.
+	return engine.Run(ctx, containerRegistryComponent{RegistryAuthRef: registryRef})
 }
 
 //go:embed autopatch.sh
 var autopatch string
 
+// installAutopatch installs the autopatch script on every node in the
+// cluster concurrently, aggregating any per-node failures.
 func installAutopatch(ctx context.Context) error {
-	k8s, err := getK8s()
+	cluster, err := loadCluster()
 	if err != nil {
 		return err
 	}
-	err = k8s.WriteFile(
+	var wg sync.WaitGroup
+	errs := make([]error, len(cluster.Nodes))
+	for i, n := range cluster.Nodes {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			errs[i] = installAutopatchOn(ctx, name)
+		}(i, n.Name)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func installAutopatchOn(ctx context.Context, name string) error {
+	node, err := getNode(name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	err = node.WriteFile(
 		fs.WithFileMode(ctx, 0755),
 		"/usr/local/bin/autopatch",
 		[]byte(autopatch),
 	)
 	if err != nil {
-		return fmt.Errorf("could not install autopatch: %w", err)
+		return fmt.Errorf("%s: could not install autopatch: %w", name, err)
 	}
-	err = k8s.WriteFile(ctx, "/etc/cron.d/autopatch", []byte(autopatchCron))
+	err = node.WriteFile(ctx, "/etc/cron.d/autopatch", []byte(autopatchCron))
 	if err != nil {
-		return fmt.Errorf("could not install autopatch cron job: %w", err)
+		return fmt.Errorf("%s: could not install autopatch cron job: %w", name, err)
 	}
-	err = k8s.WriteFile(ctx, "/var/log/autopatch.log", []byte{})
+	err = node.WriteFile(ctx, "/var/log/autopatch.log", []byte{})
 	if err != nil {
-		return fmt.Errorf("could not create autopatch log: %w", err)
+		return fmt.Errorf("%s: could not create autopatch log: %w", name, err)
 	}
 	return nil
 }
 
+// updateK3s bootstraps the first server node, then joins every remaining
+// server and agent node to it.
 func updateK3s(ctx context.Context) error {
-	k8s, err := getK8s()
+	cluster, err := loadCluster()
 	if err != nil {
 		return err
 	}
-	_, err = command.Copy(
-		k8s.Command(ctx, "sh", "-s", "-"),
-		k8s.Command(ctx, "curl", "-sfL", "https://get.k3s.io"),
-	)
-	if err != nil {
-		return fmt.Errorf("could not update k3s: %w", err)
+	servers := cluster.Servers()
+	if len(servers) == 0 {
+		return fmt.Errorf("topology.yml: must define at least one server node")
+	}
+	first := servers[0]
+	if err := installK3s(ctx, first.Name, ""); err != nil {
+		return fmt.Errorf("could not bootstrap %s: %w", first.Name, err)
 	}
-	return nil
-}
-
-//go:embed traefik.yml
-var traefikConfig string
 
-func setupTraefik(ctx context.Context) error {
-	// k3s comes with traefik already installed.
-	// This function applies configuration to the existing installation.
-	ctl, err := getCtl()
+	agents := cluster.Agents()
+	if len(servers) == 1 && len(agents) == 0 {
+		return nil
+	}
+	token, err := k3sToken(ctx, first.Name)
 	if err != nil {
 		return err
 	}
-	_, err = command.Copy(
-		ctl.Command(ctx, "apply", "-f", "-"),
-		strings.NewReader(traefikConfig),
-	)
-	if err != nil {
-		return fmt.Errorf("could not configure traefik: %w", err)
+	env := fmt.Sprintf("K3S_URL=https://%s:6443 K3S_TOKEN=%s", first.Name, token)
+	for _, n := range servers[1:] {
+		if err := installK3s(ctx, n.Name, env, "server"); err != nil {
+			return fmt.Errorf("could not join server %s: %w", n.Name, err)
+		}
+	}
+	for _, n := range agents {
+		if err := installK3s(ctx, n.Name, env, "agent"); err != nil {
+			return fmt.Errorf("could not join agent %s: %w", n.Name, err)
+		}
 	}
 	return nil
 }
 
+//go:embed traefik.yml
+var traefikConfig string
+
 //go:embed cluster.yml
 var postgresClusterCfg string
 
-func setupPostgres(ctx context.Context) error {
-	ctl, err := getCtl()
-	if err != nil {
-		return err
-	}
-	err = command.Exec(
-		ctx,
-		ctl,
-		"apply",
-		"--server-side",     // github.com/cloudnative-pg/charts/issues/325
-		"--force-conflicts", // necessary to install over existing versions
-		"-f",
-		"https://raw.githubusercontent.com/cloudnative-pg/cloudnative-pg/"+
-			"release-1.25/releases/cnpg-1.25.0.yaml",
-	)
-	if err != nil {
-		return fmt.Errorf("could not install CNPG: %w", err)
-	}
-	_, err = command.Copy(
-		ctl.Command(ctx, "apply", "-f", "-"),
-		strings.NewReader(postgresClusterCfg),
-	)
-	if err != nil {
-		return fmt.Errorf("could not install PG cluster: %w", err)
-	}
-	return nil
-}
-
 const secretCfg = `apiVersion: v1
 kind: Secret
 metadata:
@@ -236,49 +308,6 @@ stringData:
 //go:embed issuer.yml
 var issuerCfg string
 
-func setupCertManager(ctx context.Context) error {
-	ctl, err := getCtl()
-	if err != nil {
-		return err
-	}
-	spkez, err := getSpkez()
-	if err != nil {
-		return err
-	}
-	err = command.Exec(
-		ctx,
-		ctl,
-		"apply",
-		"-f",
-		"https://github.com/cert-manager/cert-manager/"+
-			"releases/download/v1.17.1/cert-manager.yaml",
-	)
-	if err != nil {
-		return fmt.Errorf("could not install cert-manager: %w", err)
-	}
-	r, err := command.Call(ctx, spkez, "get", "k8s/cert-manager/cloudflare")
-	if err != nil {
-		return fmt.Errorf("could not get cloudflare API key: %w", err)
-	}
-	_, err = command.Copy(
-		ctl.Command(ctx, "apply", "-f", "-"),
-		strings.NewReader(fmt.Sprintf(
-			secretCfg, "cert-manager-cloudflare-token", "api-token", r,
-		)),
-	)
-	if err != nil {
-		return fmt.Errorf("could not store cloudflare secret: %w", err)
-	}
-	_, err = command.Copy(
-		ctl.Command(ctx, "apply", "-f", "-"),
-		strings.NewReader(issuerCfg),
-	)
-	if err != nil {
-		return fmt.Errorf("could not create cloudflare issuer: %w", err)
-	}
-	return nil
-}
-
 //go:embed registry.yml
 var registryCfg string
 
@@ -291,54 +320,10 @@ stringData:
   username: %s
   password: %s`
 
-func setupContainerRegistry(ctx context.Context) error {
-	ctl, err := getCtl()
-	if err != nil {
-		return err
-	}
-	spkez, err := getSpkez()
-	if err != nil {
-		return err
-	}
-	r, err := command.Call(ctx, spkez, "get", "ctr.lesiw.dev/auth")
-	if err != nil {
-		return fmt.Errorf("could not get registry auth secret: %w", err)
-	}
-	reguser, regpass := "ll", r
-	_, err = command.Copy(
-		ctl.Command(ctx, "apply", "-f", "-"),
-		strings.NewReader(fmt.Sprintf(
-			basicAuthCfg, "registry-auth-secret", reguser, regpass,
-		)),
-	)
-	if err != nil {
-		return fmt.Errorf("could not store registry auth secret: %w", err)
-	}
-	_, err = command.Copy(
-		ctl.Command(ctx, "apply", "-f", "-"),
-		strings.NewReader(registryCfg),
-	)
-	if err != nil {
-		return fmt.Errorf("could not install registry: %w", err)
-	}
-
-	err = command.Exec(ctx, ctl, "get", "secret", "regcred")
-	if err != nil {
-		trace := command.Trace
-		defer func() { command.Trace = trace }()
-		command.Trace = io.Discard // Hide the registry secret.
-		err = command.Exec(
-			ctx,
-			ctl,
-			"create", "secret", "docker-registry", "regcred",
-			"--docker-server=ctr.lesiw.dev",
-			"--docker-username="+reguser,
-			"--docker-password="+regpass,
-		)
-		if err != nil {
-			return fmt.Errorf("could not store registry secret: %w", err)
-		}
-		command.Trace = trace
-	}
-	return nil
-}
+const dockerConfigJSONCfg = `apiVersion: v1
+kind: Secret
+metadata:
+  name: %s
+type: kubernetes.io/dockerconfigjson
+data:
+  .dockerconfigjson: %s`
@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"lesiw.io/command"
 	"lesiw.io/command/mock"
 	"lesiw.io/fs"
+	"lesiw.io/k8s/secrets"
 )
 
 func swap[T any](t *testing.T, orig *T, with T) {
@@ -20,7 +26,10 @@ func swap[T any](t *testing.T, orig *T, with T) {
 
 func TestInstallAutopatch(t *testing.T) {
 	sh := command.Shell(mock.New())
-	swap(t, &getK8s, func() (*command.Sh, error) { return sh, nil })
+	swap(t, &loadCluster, func() (Cluster, error) {
+		return Cluster{Nodes: []Node{{Name: "k8s.lesiw.dev", Role: RoleServer}}}, nil
+	})
+	swap(t, &getNode, func(name string) (*command.Sh, error) { return sh, nil })
 
 	if err := installAutopatch(t.Context()); err != nil {
 		t.Fatalf("installAutopatch() err: %v", err)
@@ -62,7 +71,10 @@ func TestUpdateK3s(t *testing.T) {
 	sh := command.Shell(mock.New())
 	sh.Handle("curl", sh.Unshell())
 	sh.Handle("sh", sh.Unshell())
-	swap(t, &getK8s, func() (*command.Sh, error) { return sh, nil })
+	swap(t, &loadCluster, func() (Cluster, error) {
+		return Cluster{Nodes: []Node{{Name: "k8s.lesiw.dev", Role: RoleServer}}}, nil
+	})
+	swap(t, &getNode, func(name string) (*command.Sh, error) { return sh, nil })
 
 	if err := updateK3s(t.Context()); err != nil {
 		t.Fatalf("updateK3s() err: %v", err)
@@ -91,12 +103,120 @@ func TestUpdateK3s(t *testing.T) {
 	}
 }
 
+func TestUpdateK3sMultiNode(t *testing.T) {
+	shells := map[string]*command.Sh{}
+	for _, name := range []string{"server-1", "server-2", "agent-1"} {
+		sh := command.Shell(mock.New())
+		sh.Handle("curl", sh.Unshell())
+		sh.Handle("sh", sh.Unshell())
+		shells[name] = sh
+	}
+	err := shells["server-1"].WriteFile(
+		t.Context(),
+		"/var/lib/rancher/k3s/server/node-token",
+		[]byte("test-token\n"),
+	)
+	if err != nil {
+		t.Fatalf("WriteFile(node-token) err: %v", err)
+	}
+
+	swap(t, &loadCluster, func() (Cluster, error) {
+		return Cluster{Nodes: []Node{
+			{Name: "server-1", Role: RoleServer},
+			{Name: "server-2", Role: RoleServer},
+			{Name: "agent-1", Role: RoleAgent},
+		}}, nil
+	})
+	swap(t, &getNode, func(name string) (*command.Sh, error) {
+		return shells[name], nil
+	})
+
+	if err := updateK3s(t.Context()); err != nil {
+		t.Fatalf("updateK3s() err: %v", err)
+	}
+
+	// server-1 bootstraps plainly, same as the single-node case.
+	if got, want := len(mock.CallsFor(shells["server-1"], "sh")), 1; got != want {
+		t.Fatalf("server-1 sh call count = %d, want %d", got, want)
+	}
+	if diff := cmp.Diff(
+		[]string{"sh", "-s", "-"},
+		mock.CallsFor(shells["server-1"], "sh")[0].Args,
+	); diff != "" {
+		t.Errorf("server-1 sh args (-want +got):\n%s", diff)
+	}
+
+	// server-2 and agent-1 join via a wrapped shell carrying the token.
+	server2Calls := mock.CallsFor(shells["server-2"], "sh")
+	if got, want := len(server2Calls), 1; got != want {
+		t.Fatalf("server-2 sh call count = %d, want %d", got, want)
+	}
+	if got, want := server2Calls[0].Args[:2], []string{"sh", "-c"}; !cmp.Equal(got, want) {
+		t.Errorf("server-2 sh args = %v, want prefix %v", server2Calls[0].Args, want)
+	}
+	if !strings.Contains(server2Calls[0].Args[2], "server") {
+		t.Errorf("server-2 join script missing server role: %q", server2Calls[0].Args[2])
+	}
+
+	agentCalls := mock.CallsFor(shells["agent-1"], "sh")
+	if got, want := len(agentCalls), 1; got != want {
+		t.Fatalf("agent-1 sh call count = %d, want %d", got, want)
+	}
+	if !strings.Contains(agentCalls[0].Args[2], "agent") {
+		t.Errorf("agent-1 join script missing agent role: %q", agentCalls[0].Args[2])
+	}
+}
+
+func TestParseCluster(t *testing.T) {
+	c, err := parseCluster(`nodes:
+  - name: server-1
+    role: server
+  - name: agent-1
+    role: agent
+`)
+	if err != nil {
+		t.Fatalf("parseCluster() err: %v", err)
+	}
+	if diff := cmp.Diff([]Node{
+		{Name: "server-1", Role: RoleServer},
+		{Name: "agent-1", Role: RoleAgent},
+	}, c.Nodes); diff != "" {
+		t.Errorf("nodes (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]Node{{Name: "server-1", Role: RoleServer}}, c.Servers()); diff != "" {
+		t.Errorf("Servers() (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]Node{{Name: "agent-1", Role: RoleAgent}}, c.Agents()); diff != "" {
+		t.Errorf("Agents() (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseClusterEmpty(t *testing.T) {
+	if _, err := parseCluster(""); err == nil {
+		t.Fatal("parseCluster(\"\") err = nil, want error")
+	}
+}
+
+func TestParseClusterUnknownRole(t *testing.T) {
+	_, err := parseCluster(`nodes:
+  - name: server-1
+    role: servr
+`)
+	if err == nil {
+		t.Fatal("parseCluster() with a misspelled role err = nil, want error")
+	}
+	if !strings.Contains(err.Error(), `unknown role "servr"`) {
+		t.Errorf("parseCluster() err = %q, want it to name the bad role", err)
+	}
+}
+
 func TestSetupTraefik(t *testing.T) {
 	ctl := mock.New()
 	swap(t, &getCtl, func() (command.Machine, error) { return ctl, nil })
 
-	if err := setupTraefik(t.Context()); err != nil {
-		t.Fatalf("setupTraefik() err: %v", err)
+	engine := &Engine{}
+	if err := engine.Run(t.Context(), traefikComponent{}); err != nil {
+		t.Fatalf("engine.Run() err: %v", err)
 	}
 
 	applyCalls := mock.CallsFor(ctl, "apply")
@@ -114,14 +234,32 @@ func TestSetupTraefik(t *testing.T) {
 	if got, want := string(applyCalls[0].Got), traefikConfig; got != want {
 		t.Errorf("apply stdin:\n%s", cmp.Diff(want, got))
 	}
+
+	assertAnnotated(t, ctl, "HelmChartConfig", "traefik", manifestHash(traefikConfig))
+}
+
+func TestTraefikComponentUpToDate(t *testing.T) {
+	ctl := mock.New()
+	ctl.Return("get", liveObjectJSON(manifestHash(traefikConfig)))
+	swap(t, &getCtl, func() (command.Machine, error) { return ctl, nil })
+
+	engine := &Engine{}
+	if err := engine.Run(t.Context(), traefikComponent{}); err != nil {
+		t.Fatalf("engine.Run() err: %v", err)
+	}
+
+	if applyCalls := mock.CallsFor(ctl, "apply"); len(applyCalls) != 0 {
+		t.Errorf("apply call count = %d, want 0", len(applyCalls))
+	}
 }
 
-func TestSetupPostgres(t *testing.T) {
+func TestPostgresComponent(t *testing.T) {
 	ctl := mock.New()
 	swap(t, &getCtl, func() (command.Machine, error) { return ctl, nil })
 
-	if err := setupPostgres(t.Context()); err != nil {
-		t.Fatalf("setupPostgres() err: %v", err)
+	engine := &Engine{}
+	if err := engine.Run(t.Context(), postgresComponent{}); err != nil {
+		t.Fatalf("engine.Run() err: %v", err)
 	}
 
 	applyCalls := mock.CallsFor(ctl, "apply")
@@ -130,8 +268,6 @@ func TestSetupPostgres(t *testing.T) {
 	}
 
 	// Verify CNPG operator installation
-	cnpgURL := "https://raw.githubusercontent.com/cloudnative-pg/" +
-		"cloudnative-pg/release-1.25/releases/cnpg-1.25.0.yaml"
 	if diff := cmp.Diff(
 		[]string{"apply", "--server-side", "--force-conflicts", "-f",
 			cnpgURL},
@@ -152,17 +288,78 @@ func TestSetupPostgres(t *testing.T) {
 	if got != want {
 		t.Errorf("apply stdin:\n%s", cmp.Diff(want, got))
 	}
+
+	assertAnnotated(t, ctl, "Deployment", "cnpg-controller-manager", manifestHash(cnpgURL))
+	assertAnnotated(t, ctl, "Cluster", "postgres", manifestHash(postgresClusterCfg))
+}
+
+func TestPostgresComponentWithBarman(t *testing.T) {
+	ctl := mock.New()
+	swap(t, &getCtl, func() (command.Machine, error) { return ctl, nil })
+
+	component := postgresComponent{Barman: &BarmanConfig{
+		DestinationPath: "s3://backups/postgres",
+		EndpointURL:     "https://s3.example.com",
+		CredentialsRef:  secrets.SecretRef("env://BARMAN_CREDS"),
+	}}
+	t.Setenv("BARMAN_CREDS", "key-id:key-secret")
+
+	engine := &Engine{}
+	if err := engine.Run(t.Context(), component); err != nil {
+		t.Fatalf("engine.Run() err: %v", err)
+	}
+
+	applyCalls := mock.CallsFor(ctl, "apply")
+	// CNPG operator + backup creds + ScheduledBackup + Cluster
+	if got, want := len(applyCalls), 4; got != want {
+		t.Fatalf("apply call count = %d, want %d", got, want)
+	}
+
+	credsData := string(applyCalls[1].Got)
+	if !strings.Contains(credsData, "key-id") || !strings.Contains(credsData, "key-secret") {
+		t.Errorf("backup creds secret does not contain credentials: %q", credsData)
+	}
+
+	if got, want := string(applyCalls[2].Got), scheduledBackupCfg; got != want {
+		t.Errorf("scheduled backup config:\n%s", cmp.Diff(want, got))
+	}
+
+	clusterData := string(applyCalls[3].Got)
+	if !strings.Contains(clusterData, "s3://backups/postgres") {
+		t.Errorf("cluster config missing barman destination path: %q", clusterData)
+	}
+
+	assertAnnotated(t, ctl, "Secret", "postgres-backup-creds",
+		manifestHash(fmt.Sprintf(barmanCredsCfg, "key-id", "key-secret")))
+	assertAnnotated(t, ctl, "ScheduledBackup", "postgres-weekly", manifestHash(scheduledBackupCfg))
+}
+
+func TestBarmanConfig(t *testing.T) {
+	if got := barmanConfig("", "", ""); got != nil {
+		t.Errorf("barmanConfig() with no flags = %+v, want nil", got)
+	}
+
+	got := barmanConfig("s3://backups/postgres", "https://s3.example.com", "env://BARMAN_CREDS")
+	want := &BarmanConfig{
+		DestinationPath: "s3://backups/postgres",
+		EndpointURL:     "https://s3.example.com",
+		CredentialsRef:  secrets.SecretRef("env://BARMAN_CREDS"),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("barmanConfig() mismatch (-want +got):\n%s", diff)
+	}
 }
 
-func TestSetupCertManager(t *testing.T) {
+func TestCertManagerComponent(t *testing.T) {
 	ctl := mock.New()
 	spkez := mock.New()
 	spkez.Return("get", "fake-cloudflare-token\n")
 	swap(t, &getCtl, func() (command.Machine, error) { return ctl, nil })
 	swap(t, &getSpkez, func() (command.Machine, error) { return spkez, nil })
 
-	if err := setupCertManager(t.Context()); err != nil {
-		t.Fatalf("setupCertManager() err: %v", err)
+	engine := &Engine{}
+	if err := engine.Run(t.Context(), certManagerComponent{}); err != nil {
+		t.Fatalf("engine.Run() err: %v", err)
 	}
 
 	applyCalls := mock.CallsFor(ctl, "apply")
@@ -171,10 +368,8 @@ func TestSetupCertManager(t *testing.T) {
 	}
 
 	// Verify cert-manager installation
-	certURL := "https://github.com/cert-manager/cert-manager/" +
-		"releases/download/v1.17.1/cert-manager.yaml"
 	if diff := cmp.Diff(
-		[]string{"apply", "-f", certURL},
+		[]string{"apply", "-f", certManagerURL},
 		applyCalls[0].Args,
 	); diff != "" {
 		t.Errorf("cert-manager install args (-want +got):\n%s", diff)
@@ -211,17 +406,24 @@ func TestSetupCertManager(t *testing.T) {
 	if got, want := string(applyCalls[2].Got), issuerCfg; got != want {
 		t.Errorf("issuer config:\n%s", cmp.Diff(want, got))
 	}
+
+	assertAnnotated(t, ctl, "Deployment", "cert-manager-webhook", manifestHash(certManagerURL))
+	assertAnnotated(t, ctl, "Secret", "cert-manager-cloudflare-token",
+		manifestHash(fmt.Sprintf(secretCfg, "cert-manager-cloudflare-token",
+			"api-token", "fake-cloudflare-token\n")))
+	assertAnnotated(t, ctl, "ClusterIssuer", "cloudflare", manifestHash(issuerCfg))
 }
 
-func TestSetupContainerRegistry(t *testing.T) {
+func TestContainerRegistryComponent(t *testing.T) {
 	ctl := mock.New()
 	spkez := mock.New()
 	spkez.Return("get", "fake-registry-password\n")
 	swap(t, &getCtl, func() (command.Machine, error) { return ctl, nil })
 	swap(t, &getSpkez, func() (command.Machine, error) { return spkez, nil })
 
-	if err := setupContainerRegistry(t.Context()); err != nil {
-		t.Fatalf("setupContainerRegistry() err: %v", err)
+	engine := &Engine{}
+	if err := engine.Run(t.Context(), containerRegistryComponent{}); err != nil {
+		t.Fatalf("engine.Run() err: %v", err)
 	}
 
 	// Verify spkez was called to get registry auth
@@ -237,7 +439,7 @@ func TestSetupContainerRegistry(t *testing.T) {
 	}
 
 	applyCalls := mock.CallsFor(ctl, "apply")
-	if got, want := len(applyCalls), 2; got != want {
+	if got, want := len(applyCalls), 3; got != want {
 		t.Fatalf("apply call count = %d, want %d", got, want)
 	}
 
@@ -261,15 +463,327 @@ func TestSetupContainerRegistry(t *testing.T) {
 		t.Errorf("registry config:\n%s", cmp.Diff(want, got))
 	}
 
-	// Verify regcred existence check was performed
-	getSecretCalls := mock.CallsFor(ctl, "get")
-	if got, want := len(getSecretCalls), 1; got != want {
-		t.Fatalf("get secret call count = %d, want %d", got, want)
+	// Verify regcred was applied as a dockerconfigjson Secret, so a
+	// second run (e.g. a password rotation) doesn't fail with AlreadyExists.
+	regcred, err := dockerConfigJSON("ctr.lesiw.dev", "ll", "fake-registry-password\n")
+	if err != nil {
+		t.Fatalf("dockerConfigJSON() err: %v", err)
 	}
-	if diff := cmp.Diff(
-		[]string{"get", "secret", "regcred"},
-		getSecretCalls[0].Args,
-	); diff != "" {
-		t.Errorf("get secret args (-want +got):\n%s", diff)
+	regcredCfg := fmt.Sprintf(dockerConfigJSONCfg, "regcred", regcred)
+	if got, want := string(applyCalls[2].Got), regcredCfg; got != want {
+		t.Errorf("regcred secret:\n%s", cmp.Diff(want, got))
+	}
+	if mock.CallsFor(ctl, "create") != nil {
+		t.Error("containerRegistryComponent used kubectl create; want apply only")
+	}
+
+	assertAnnotated(t, ctl, "Secret", "registry-auth-secret",
+		manifestHash(fmt.Sprintf(basicAuthCfg, "registry-auth-secret", "ll",
+			"fake-registry-password\n")))
+	assertAnnotated(t, ctl, "Deployment", "container-registry", manifestHash(registryCfg))
+	assertAnnotated(t, ctl, "Secret", "regcred", manifestHash(regcredCfg))
+}
+
+func TestDiffManifests(t *testing.T) {
+	desired := []Manifest{
+		{Kind: "Secret", Name: "a", Hash: "1"},
+		{Kind: "Secret", Name: "b", Hash: "2"},
+	}
+	live := []Manifest{
+		{Kind: "Secret", Name: "a", Hash: "1"},     // unchanged
+		{Kind: "Secret", Name: "b", Hash: "stale"}, // needs update
+	}
+
+	diff := diffManifests(desired, live)
+	if got, want := len(diff), 1; got != want {
+		t.Fatalf("len(diff) = %d, want %d", got, want)
+	}
+	if got, want := diff[0].Name, "b"; got != want {
+		t.Errorf("diff[0].Name = %q, want %q", got, want)
+	}
+}
+
+// assertAnnotated checks that an annotate call stamped the given hash onto
+// the named object.
+func assertAnnotated(t *testing.T, ctl command.Machine, kind, name, hash string) {
+	t.Helper()
+	for _, c := range mock.CallsFor(ctl, "annotate") {
+		if len(c.Args) > 2 && c.Args[1] == kind && c.Args[2] == name {
+			want := appliedHashAnnotation + "=" + hash
+			if len(c.Args) < 4 || c.Args[3] != want {
+				t.Errorf("annotate %s/%s args = %v, want %q at index 3",
+					kind, name, c.Args, want)
+			}
+			return
+		}
+	}
+	t.Errorf("no annotate call found for %s/%s", kind, name)
+}
+
+// liveObjectJSON renders a minimal object carrying the applied-hash
+// annotation, as returned by `kubectl get -o json`.
+func liveObjectJSON(hash string) string {
+	return fmt.Sprintf(
+		`{"metadata":{"annotations":{%q:%q}}}`, appliedHashAnnotation, hash,
+	)
+}
+
+func TestEncryptDecryptRoundtrip(t *testing.T) {
+	plaintext := []byte("super secret contents")
+	ciphertext, err := encrypt(plaintext, "passphrase")
+	if err != nil {
+		t.Fatalf("encrypt() err: %v", err)
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Errorf("ciphertext contains plaintext in the clear")
+	}
+	got, err := decrypt(ciphertext, "passphrase")
+	if err != nil {
+		t.Fatalf("decrypt() err: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("decrypt() = %q, want %q", got, plaintext)
+	}
+	if _, err := decrypt(ciphertext, "wrong passphrase"); err == nil {
+		t.Error("decrypt() with wrong passphrase err = nil, want error")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	ctl := mock.New()
+	ctl.Return("get", `{"secret":"value"}`)
+	swap(t, &getCtl, func() (command.Machine, error) { return ctl, nil })
+	t.Setenv("BACKUP_KEY", "test-key")
+	swap(t, &backupEncryptionKeyRef, secrets.SecretRef("env://BACKUP_KEY"))
+
+	path := t.TempDir() + "/secrets.tar.enc"
+	if err := backup(t.Context(), path); err != nil {
+		t.Fatalf("backup() err: %v", err)
+	}
+
+	applyCalls := mock.CallsFor(ctl, "apply")
+	if got, want := len(applyCalls), 1; got != want {
+		t.Fatalf("apply call count = %d, want %d", got, want)
+	}
+	if got, want := string(applyCalls[0].Got), backupCfg; got != want {
+		t.Errorf("backup CR:\n%s", cmp.Diff(want, got))
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("secrets tarball was not written: %v", err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ctl := mock.New()
+	ctl.Return("get", `{"secret":"value"}`)
+	swap(t, &getCtl, func() (command.Machine, error) { return ctl, nil })
+	t.Setenv("BACKUP_KEY", "test-key")
+	swap(t, &backupEncryptionKeyRef, secrets.SecretRef("env://BACKUP_KEY"))
+
+	path := t.TempDir() + "/secrets.tar.enc"
+	if err := backup(t.Context(), path); err != nil {
+		t.Fatalf("backup() err: %v", err)
+	}
+
+	if err := restore(t.Context(), "postgres-backup-abc123", path); err != nil {
+		t.Fatalf("restore() err: %v", err)
+	}
+
+	applyCalls := mock.CallsFor(ctl, "apply")
+	// 1 backup CR + len(managedSecrets) restored secrets + 1 recovery cluster
+	if got, want := len(applyCalls), 2+len(managedSecrets); got != want {
+		t.Fatalf("apply call count = %d, want %d", got, want)
+	}
+	last := applyCalls[len(applyCalls)-1]
+	if !strings.Contains(string(last.Got), "postgres-backup-abc123") {
+		t.Errorf("recovery cluster config missing backup source: %q", last.Got)
+	}
+}
+
+func TestRestoreRequiresSource(t *testing.T) {
+	if err := restore(t.Context(), "", "ignored.tar.enc"); err == nil {
+		t.Error("restore() with empty source err = nil, want error")
+	}
+}
+
+func TestFreeLocalPort(t *testing.T) {
+	port, err := freeLocalPort()
+	if err != nil {
+		t.Fatalf("freeLocalPort() err: %v", err)
+	}
+	if port <= 0 || port > 65535 {
+		t.Errorf("freeLocalPort() = %d, want a valid TCP port", port)
+	}
+}
+
+func TestOpenTunnelNoServers(t *testing.T) {
+	swap(t, &loadCluster, func() (Cluster, error) {
+		return Cluster{Nodes: []Node{{Name: "agent-1", Role: RoleAgent}}}, nil
+	})
+
+	if _, err := OpenTunnel(t.Context(), "my-svc", "default", 5432); err == nil {
+		t.Error("OpenTunnel() with no server nodes err = nil, want error")
+	}
+}
+
+func TestOpenTunnelRunsOverSSH(t *testing.T) {
+	sh := command.Shell(mock.New())
+	sh.Handle("ssh", sh.Unshell())
+	swap(t, &loadCluster, func() (Cluster, error) {
+		return Cluster{Nodes: []Node{{Name: "k8s.lesiw.dev", Role: RoleServer}}}, nil
+	})
+	swap(t, &localSSH, func() *command.Sh { return sh })
+	t.Setenv("INFRA_SSH", "fake-key")
+	swap(t, &sshKeyRef, secrets.SecretRef("env://INFRA_SSH"))
+
+	tun, err := OpenTunnel(t.Context(), "my-svc", "my-ns", 5432)
+	if err != nil {
+		t.Fatalf("OpenTunnel() err: %v", err)
+	}
+	defer tun.Close()
+
+	if tun.LocalPort() <= 0 {
+		t.Errorf("LocalPort() = %d, want > 0", tun.LocalPort())
+	}
+	if want := fmt.Sprintf("http://localhost:%d", tun.LocalPort()); tun.URL() != want {
+		t.Errorf("URL() = %q, want %q", tun.URL(), want)
+	}
+
+	calls := mock.CallsFor(sh, "ssh")
+	if got, want := len(calls), 1; got != want {
+		t.Fatalf("ssh call count = %d, want %d", got, want)
+	}
+	args := calls[0].Args
+	if !strings.Contains(strings.Join(args, " "), "kubectl port-forward svc/my-svc 5432 -n my-ns") {
+		t.Errorf("ssh args = %v, want a kubectl port-forward invocation", args)
+	}
+}
+
+func TestReadyWatcherDetectsForwardingLine(t *testing.T) {
+	w := &readyWatcher{ready: make(chan struct{})}
+
+	if _, err := w.Write([]byte("Forwarding f")); err != nil {
+		t.Fatalf("Write() err: %v", err)
+	}
+	select {
+	case <-w.ready:
+		t.Fatal("ready closed before the forwarding line was complete")
+	default:
+	}
+
+	if _, err := w.Write([]byte("rom 127.0.0.1:8080 -> 80\n")); err != nil {
+		t.Fatalf("Write() err: %v", err)
+	}
+	select {
+	case <-w.ready:
+	default:
+		t.Fatal("ready not closed after seeing the forwarding line")
+	}
+}
+
+func TestWaitForTransitionsToReady(t *testing.T) {
+	calls := 0
+	swap(t, &conditionTrue, func(
+		ctx context.Context, ctl command.Machine, kind, namespace, name, cond string,
+	) (bool, error) {
+		calls++
+		return calls >= 3, nil
+	})
+	swap(t, &waitForInitialBackoff, time.Millisecond)
+	swap(t, &waitForMaxBackoff, time.Millisecond)
+	swap(t, &waitForTimeout, time.Second)
+
+	err := waitFor(t.Context(), mock.New(), "Cluster", "default", "postgres", "Ready")
+	if err != nil {
+		t.Fatalf("waitFor() err: %v", err)
+	}
+	if calls < 3 {
+		t.Errorf("conditionTrue called %d times, want at least 3", calls)
+	}
+}
+
+func TestWaitForTimesOut(t *testing.T) {
+	swap(t, &conditionTrue, func(
+		ctx context.Context, ctl command.Machine, kind, namespace, name, cond string,
+	) (bool, error) {
+		return false, nil
+	})
+	swap(t, &waitForInitialBackoff, time.Millisecond)
+	swap(t, &waitForMaxBackoff, time.Millisecond)
+	swap(t, &waitForTimeout, 10*time.Millisecond)
+
+	err := waitFor(t.Context(), mock.New(), "Cluster", "default", "postgres", "Ready")
+	if err == nil {
+		t.Error("waitFor() err = nil, want timeout error")
+	}
+}
+
+func TestConditionTrue(t *testing.T) {
+	ctl := mock.New()
+	ctl.Return("get", `{"status":{"conditions":[{"type":"Ready","status":"True"}]}}`)
+
+	ready, err := conditionTrue(t.Context(), ctl, "Cluster", "default", "postgres", "Ready")
+	if err != nil {
+		t.Fatalf("conditionTrue() err: %v", err)
+	}
+	if !ready {
+		t.Error("conditionTrue() = false, want true")
+	}
+}
+
+func TestConditionTrueNotReady(t *testing.T) {
+	ctl := mock.New()
+	ctl.Return("get", `{"status":{"conditions":[{"type":"Ready","status":"False"}]}}`)
+
+	ready, err := conditionTrue(t.Context(), ctl, "Cluster", "default", "postgres", "Ready")
+	if err != nil {
+		t.Fatalf("conditionTrue() err: %v", err)
+	}
+	if ready {
+		t.Error("conditionTrue() = true, want false")
+	}
+}
+
+func TestConditionTruePropagatesError(t *testing.T) {
+	wantErr := errors.New("connection refused")
+	ctl := failingMachine{err: wantErr}
+
+	_, err := conditionTrue(t.Context(), ctl, "Cluster", "default", "postgres", "Ready")
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("conditionTrue() err = %v, want %v", err, wantErr)
+	}
+}
+
+func TestWaitForPropagatesNonNotFoundError(t *testing.T) {
+	wantErr := errors.New("connection refused")
+	ctl := failingMachine{err: wantErr}
+	swap(t, &waitForInitialBackoff, time.Millisecond)
+	swap(t, &waitForMaxBackoff, time.Millisecond)
+	swap(t, &waitForTimeout, time.Minute)
+
+	err := waitFor(t.Context(), ctl, "Cluster", "default", "postgres", "Ready")
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("waitFor() err = %v, want %v", err, wantErr)
+	}
+}
+
+// failingMachine is a command.Machine whose every command fails with err,
+// for exercising error paths mock.Machine's queued responses can't express.
+type failingMachine struct{ err error }
+
+func (m failingMachine) Command(_ context.Context, _ ...string) command.Buffer {
+	return command.Fail(m.err)
+}
+
+func TestRunTunnelRequiresArgs(t *testing.T) {
+	if err := runTunnel(t.Context(), nil); err == nil {
+		t.Error("runTunnel() with no args err = nil, want error")
+	}
+	if err := runTunnel(t.Context(), []string{"my-svc"}); err == nil {
+		t.Error("runTunnel() with only a service name err = nil, want error")
+	}
+	if err := runTunnel(t.Context(), []string{"my-svc", "not-a-port"}); err == nil {
+		t.Error("runTunnel() with a non-numeric port err = nil, want error")
 	}
 }
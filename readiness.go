@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"lesiw.io/command"
+)
+
+// waitForTimeout bounds how long waitFor polls a single condition before
+// giving up. Tests shrink this (and the backoffs below) to keep runs fast.
+var waitForTimeout = 5 * time.Minute
+
+// waitForInitialBackoff is waitFor's first retry delay; each subsequent
+// retry doubles it, up to waitForMaxBackoff.
+var waitForInitialBackoff = 2 * time.Second
+var waitForMaxBackoff = 30 * time.Second
+
+// waitFor polls kind/name's status.conditions for a condition of type
+// cond with status "True", backing off exponentially between attempts,
+// until it appears or waitForTimeout elapses.
+func waitFor(ctx context.Context, ctl command.Machine, kind, namespace, name, cond string) error {
+	deadline := time.Now().Add(waitForTimeout)
+	backoff := waitForInitialBackoff
+	for {
+		ready, err := conditionTrue(ctx, ctl, kind, namespace, name, cond)
+		if err != nil {
+			return err
+		}
+		if ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s/%s condition %s", kind, name, cond)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > waitForMaxBackoff {
+			backoff = waitForMaxBackoff
+		}
+	}
+}
+
+// conditionTrue reports whether kind/name currently has a status
+// condition of type cond set to "True". A package var so tests can
+// swap it in to simulate a not-ready -> ready transition deterministically.
+var conditionTrue = func(ctx context.Context, ctl command.Machine, kind, namespace, name, cond string) (bool, error) {
+	args := []string{"get", kind, name, "-o", "json", "--ignore-not-found"}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	out, err := command.Call(ctx, ctl, args...)
+	if err != nil {
+		return false, fmt.Errorf("could not get %s/%s: %w", kind, name, err)
+	}
+	if strings.TrimSpace(out) == "" {
+		return false, nil // not found yet: keep waiting
+	}
+	var obj struct {
+		Status struct {
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(out), &obj); err != nil {
+		return false, fmt.Errorf("could not parse %s/%s: %w", kind, name, err)
+	}
+	for _, c := range obj.Status.Conditions {
+		if c.Type == cond {
+			return c.Status == "True", nil
+		}
+	}
+	return false, nil
+}
+
+// waitForPostgresReady blocks until the CNPG operator and the postgres
+// Cluster it manages both report ready, so components that depend on
+// postgres being up don't race its rollout.
+func waitForPostgresReady(ctx context.Context) error {
+	ctl, err := getCtl()
+	if err != nil {
+		return err
+	}
+	err = waitFor(ctx, ctl, "Deployment", "cnpg-system", "cnpg-controller-manager", "Available")
+	if err != nil {
+		return fmt.Errorf("cnpg operator not ready: %w", err)
+	}
+	if err := waitFor(ctx, ctl, "Cluster", "default", "postgres", "Ready"); err != nil {
+		return fmt.Errorf("postgres cluster not ready: %w", err)
+	}
+	return nil
+}
+
+// waitForCertManagerReady blocks until cert-manager's webhook and the
+// cloudflare ClusterIssuer both report ready, so containerRegistryComponent
+// doesn't request a Certificate before cert-manager can serve it.
+func waitForCertManagerReady(ctx context.Context) error {
+	ctl, err := getCtl()
+	if err != nil {
+		return err
+	}
+	err = waitFor(ctx, ctl, "Deployment", "cert-manager", "cert-manager-webhook", "Available")
+	if err != nil {
+		return fmt.Errorf("cert-manager webhook not ready: %w", err)
+	}
+	if err := waitFor(ctx, ctl, "ClusterIssuer", "", "cloudflare", "Ready"); err != nil {
+		return fmt.Errorf("cloudflare ClusterIssuer not ready: %w", err)
+	}
+	return nil
+}
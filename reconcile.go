@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"lesiw.io/command"
+)
+
+// appliedHashAnnotation records the hash of the manifest we last applied,
+// so Live can tell whether an object needs to be reconciled without
+// depending on server-side-apply's managed-fields bookkeeping.
+const appliedHashAnnotation = "k8s.lesiw.dev/applied-hash"
+
+// Manifest is a single Kubernetes object, either rendered from a
+// component's desired state or fetched from the live cluster.
+type Manifest struct {
+	Kind      string
+	Namespace string
+	Name      string
+	Hash      string // appliedHashAnnotation value: desired for Desired(), observed for Live()
+	Content   string // rendered object body, set by Desired() for Reconcile to apply
+}
+
+func (m Manifest) key() string {
+	return m.Kind + "/" + m.Namespace + "/" + m.Name
+}
+
+// manifestHash hashes manifest content so it can be compared against the
+// appliedHashAnnotation on a live object.
+func manifestHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// Component is a single piece of cluster state that the Engine can render,
+// observe, and reconcile independently.
+type Component interface {
+	// Name identifies the component in plan output and error messages.
+	Name() string
+	// Desired renders the manifests this component wants applied, each
+	// carrying the hash of its content.
+	Desired(ctx context.Context) ([]Manifest, error)
+	// Live fetches the manifests' current state from the cluster.
+	Live(ctx context.Context) ([]Manifest, error)
+	// Reconcile applies the objects named in diff.
+	Reconcile(ctx context.Context, diff []Manifest) error
+}
+
+// Engine drives the desired/live/reconcile loop across a set of components.
+type Engine struct {
+	DryRun bool
+}
+
+// Run renders, diffs, and (unless DryRun) reconciles each component in
+// order, stopping at the first error.
+func (e *Engine) Run(ctx context.Context, components ...Component) error {
+	for _, c := range components {
+		desired, err := c.Desired(ctx)
+		if err != nil {
+			return fmt.Errorf(
+				"%s: could not render desired state: %w", c.Name(), err,
+			)
+		}
+		live, err := c.Live(ctx)
+		if err != nil {
+			return fmt.Errorf(
+				"%s: could not fetch live state: %w", c.Name(), err,
+			)
+		}
+		diff := diffManifests(desired, live)
+		if len(diff) == 0 {
+			continue
+		}
+		if e.DryRun {
+			fmt.Printf("%s:\n", c.Name())
+			for _, m := range diff {
+				fmt.Printf("  apply %s %s/%s\n", m.Kind, m.Namespace, m.Name)
+			}
+			continue
+		}
+		if err := c.Reconcile(ctx, diff); err != nil {
+			return fmt.Errorf("%s: %w", c.Name(), err)
+		}
+	}
+	return nil
+}
+
+// diffManifests returns the desired manifests whose hash differs from (or
+// is absent from) the live object keyed by the same kind, namespace and
+// name. It never returns entries for live objects missing from desired;
+// this tool only ever adds or changes state, it does not prune.
+func diffManifests(desired, live []Manifest) []Manifest {
+	byKey := make(map[string]Manifest, len(live))
+	for _, m := range live {
+		byKey[m.key()] = m
+	}
+	var diff []Manifest
+	for _, d := range desired {
+		if l, ok := byKey[d.key()]; ok && l.Hash == d.Hash {
+			continue
+		}
+		diff = append(diff, d)
+	}
+	return diff
+}
+
+// liveHash fetches an object's appliedHashAnnotation, returning "" if the
+// object does not exist or was never annotated by this tool.
+func liveHash(ctx context.Context, ctl command.Machine, kind, namespace, name string) (string, error) {
+	args := []string{"get", kind, name, "-o", "json", "--ignore-not-found"}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+	out, err := command.Call(ctx, ctl, args...)
+	if err != nil {
+		return "", fmt.Errorf("could not get %s/%s: %w", kind, name, err)
+	}
+	if strings.TrimSpace(out) == "" {
+		return "", nil // not found: nothing to reconcile against
+	}
+	var obj struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal([]byte(out), &obj); err != nil {
+		return "", fmt.Errorf("could not parse %s/%s: %w", kind, name, err)
+	}
+	return obj.Metadata.Annotations[appliedHashAnnotation], nil
+}
@@ -0,0 +1,19 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// EnvProvider resolves secrets from environment variables, for users who
+// don't run spkez.
+type EnvProvider struct{}
+
+func (EnvProvider) Get(ctx context.Context, key string) (string, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", key)
+	}
+	return v, nil
+}
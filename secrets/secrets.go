@@ -0,0 +1,95 @@
+// Package secrets resolves secret references against pluggable backends,
+// selected by a reference's URI scheme. This package provides spkez:// and
+// env:// providers; any other scheme (vault://, sops://, op://, ...)
+// resolves only once a Provider is registered for it.
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Provider fetches a secret value by key.
+type Provider interface {
+	Get(ctx context.Context, key string) (string, error)
+}
+
+var providers = map[string]Provider{}
+
+// Register adds a Provider under the given URI scheme, e.g. "spkez" or
+// "env". A later Register call for the same scheme replaces the earlier
+// one; this exists mainly so tests can swap in a fake provider.
+func Register(scheme string, p Provider) {
+	providers[scheme] = p
+}
+
+// SecretRef is a URI identifying a secret, e.g.
+// "spkez://k8s/cert-manager/cloudflare" or "env://CF_TOKEN". An optional
+// fragment requests decoding of the raw value: "#base64" base64-decodes
+// it, and "#json:<path>" treats it as JSON and extracts a dotted path.
+type SecretRef string
+
+// Resolve fetches and decodes the secret ref points at.
+func (ref SecretRef) Resolve(ctx context.Context) (string, error) {
+	u, err := url.Parse(string(ref))
+	if err != nil {
+		return "", fmt.Errorf("could not parse secret ref %q: %w", ref, err)
+	}
+	p, ok := providers[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf(
+			"no secret provider registered for scheme %q", u.Scheme,
+		)
+	}
+	key := u.Host + u.Path
+	v, err := p.Get(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("%s: could not get %q: %w", u.Scheme, key, err)
+	}
+	return decode(v, u.Fragment)
+}
+
+// decode applies the transform named by fragment to a raw secret value.
+func decode(v, fragment string) (string, error) {
+	switch {
+	case fragment == "":
+		return v, nil
+	case fragment == "base64":
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			return "", fmt.Errorf("could not base64-decode secret: %w", err)
+		}
+		return string(b), nil
+	case strings.HasPrefix(fragment, "json:"):
+		return jsonPath(v, strings.TrimPrefix(fragment, "json:"))
+	default:
+		return "", fmt.Errorf("unknown secret decoding %q", fragment)
+	}
+}
+
+// jsonPath extracts a dotted path, e.g. ".data.token", from a JSON value.
+func jsonPath(v, path string) (string, error) {
+	var doc any
+	if err := json.Unmarshal([]byte(v), &doc); err != nil {
+		return "", fmt.Errorf("could not parse secret as JSON: %w", err)
+	}
+	for _, key := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		m, ok := doc.(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("json path %q: %q is not an object", path, key)
+		}
+		doc, ok = m[key]
+		if !ok {
+			return "", fmt.Errorf("json path %q: no such field %q", path, key)
+		}
+	}
+	s, ok := doc.(string)
+	if !ok {
+		return "", fmt.Errorf("json path %q: value is not a string", path)
+	}
+	return s, nil
+}
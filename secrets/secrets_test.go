@@ -0,0 +1,57 @@
+package secrets
+
+import (
+	"context"
+	"testing"
+)
+
+type stubProvider map[string]string
+
+func (s stubProvider) Get(ctx context.Context, key string) (string, error) {
+	return s[key], nil
+}
+
+func TestResolve(t *testing.T) {
+	Register("stub", stubProvider{"k8s/cert-manager/cloudflare": "plain-value"})
+	t.Cleanup(func() { delete(providers, "stub") })
+
+	got, err := SecretRef("stub://k8s/cert-manager/cloudflare").Resolve(t.Context())
+	if err != nil {
+		t.Fatalf("Resolve() err: %v", err)
+	}
+	if want := "plain-value"; got != want {
+		t.Errorf("Resolve() = %q, want %q", got, want)
+	}
+}
+
+func TestResolveBase64(t *testing.T) {
+	Register("stub", stubProvider{"host/key": "aGVsbG8="})
+	t.Cleanup(func() { delete(providers, "stub") })
+
+	got, err := SecretRef("stub://host/key#base64").Resolve(t.Context())
+	if err != nil {
+		t.Fatalf("Resolve() err: %v", err)
+	}
+	if want := "hello"; got != want {
+		t.Errorf("Resolve() = %q, want %q", got, want)
+	}
+}
+
+func TestResolveJSONPath(t *testing.T) {
+	Register("stub", stubProvider{"host/key": `{"data":{"token":"secret-value"}}`})
+	t.Cleanup(func() { delete(providers, "stub") })
+
+	got, err := SecretRef("stub://host/key#json:.data.token").Resolve(t.Context())
+	if err != nil {
+		t.Fatalf("Resolve() err: %v", err)
+	}
+	if want := "secret-value"; got != want {
+		t.Errorf("Resolve() = %q, want %q", got, want)
+	}
+}
+
+func TestResolveUnknownScheme(t *testing.T) {
+	if _, err := SecretRef("vault://secret/data/foo").Resolve(t.Context()); err == nil {
+		t.Fatal("Resolve() err = nil, want error for unregistered scheme")
+	}
+}
@@ -0,0 +1,22 @@
+package secrets
+
+import (
+	"context"
+
+	"lesiw.io/command"
+)
+
+// SpkezProvider resolves secrets by shelling out to spkez. Machine is
+// called lazily so spkez isn't located (or installed) until a secret is
+// actually needed.
+type SpkezProvider struct {
+	Machine func() (command.Machine, error)
+}
+
+func (p SpkezProvider) Get(ctx context.Context, key string) (string, error) {
+	spkez, err := p.Machine()
+	if err != nil {
+		return "", err
+	}
+	return command.Call(ctx, spkez, "get", key)
+}
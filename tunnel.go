@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"lesiw.io/command"
+)
+
+// tunnelRetries bounds how many times a Tunnel restarts kubectl
+// port-forward after a transient EOF before giving up.
+const tunnelRetries = 3
+
+// tunnelStartTimeout bounds how long OpenTunnel waits for kubectl
+// port-forward to report the tunnel is up.
+const tunnelStartTimeout = 10 * time.Second
+
+// tunnelReadyLine is the line kubectl port-forward writes once the
+// forward is actually accepting connections.
+const tunnelReadyLine = "Forwarding from"
+
+// Tunnel is a live port-forward from the operator's machine, through the
+// cluster's primary server node, to a Kubernetes service.
+type Tunnel struct {
+	localPort int
+	cancel    context.CancelFunc
+	done      chan error
+}
+
+// LocalPort is the local TCP port the tunnel is listening on.
+func (t *Tunnel) LocalPort() int { return t.localPort }
+
+// URL is the tunnel's local HTTP endpoint.
+func (t *Tunnel) URL() string { return fmt.Sprintf("http://localhost:%d", t.localPort) }
+
+// Close stops the tunnel and waits for its ssh process to exit.
+func (t *Tunnel) Close() error {
+	t.cancel()
+	return <-t.done
+}
+
+// OpenTunnel opens a port-forward to svc/remotePort in namespace, over
+// its own ssh process to the same host and key getK8s/getNode use. It
+// picks a free local port and retries kubectl port-forward on transient
+// EOFs (e.g. the pod restarting).
+func OpenTunnel(ctx context.Context, svc, namespace string, remotePort int) (*Tunnel, error) {
+	cluster, err := loadCluster()
+	if err != nil {
+		return nil, err
+	}
+	servers := cluster.Servers()
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("topology.yml: must define at least one server node")
+	}
+	host := servers[0].Name
+
+	localPort, err := freeLocalPort()
+	if err != nil {
+		return nil, fmt.Errorf("could not pick a free local port: %w", err)
+	}
+	sshkeyPath, err := sshKeyPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tunCtx, cancel := context.WithCancel(ctx)
+	t := &Tunnel{localPort: localPort, cancel: cancel, done: make(chan error, 1)}
+
+	started := make(chan error, 1)
+	go t.run(tunCtx, sshkeyPath, host, svc, namespace, remotePort, started)
+
+	select {
+	case err := <-started:
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("could not open tunnel to %s/%s: %w", namespace, svc, err)
+		}
+	case <-time.After(tunnelStartTimeout):
+		cancel()
+		return nil, fmt.Errorf("timed out waiting for tunnel to %s/%s", namespace, svc)
+	}
+	return t, nil
+}
+
+// run keeps the tunnel alive, restarting kubectl port-forward on
+// transient EOFs until ctx is canceled or retries are exhausted. It
+// reports the outcome of the first attempt on started, and its final
+// exit error on t.done.
+func (t *Tunnel) run(
+	ctx context.Context,
+	sshkeyPath, host, svc, namespace string,
+	remotePort int,
+	started chan<- error,
+) {
+	args := []string{
+		"ssh",
+		"-i", sshkeyPath,
+		"-L", fmt.Sprintf("%d:localhost:%d", t.localPort, remotePort),
+		host, "--",
+		"kubectl", "port-forward",
+		fmt.Sprintf("svc/%s", svc),
+		strconv.Itoa(remotePort),
+	}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	}
+
+	sh := localSSH()
+	for attempt := 0; attempt <= tunnelRetries; attempt++ {
+		err := t.execOnce(ctx, sh, args, started)
+		started = nil // only the first attempt reports back to OpenTunnel
+		if ctx.Err() != nil {
+			t.done <- nil
+			return
+		}
+		if !errors.Is(err, io.EOF) {
+			t.done <- err
+			return
+		}
+	}
+	t.done <- fmt.Errorf("exceeded %d retries", tunnelRetries)
+}
+
+// execOnce runs a single ssh attempt. If started is non-nil, it reports
+// readiness as soon as kubectl port-forward announces the tunnel is up,
+// rather than waiting for the long-lived ssh process to exit. Both
+// streams are watched for the announcement, and streamed through
+// command.Trace so -v shows the forward.
+func (t *Tunnel) execOnce(ctx context.Context, sh *command.Sh, args []string, started chan<- error) error {
+	buf := sh.Command(ctx, args...)
+
+	ready := make(chan struct{})
+	watch := &readyWatcher{ready: ready}
+	command.Log(buf, watch)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(watch, buf)
+		errc <- err
+	}()
+
+	if started == nil {
+		return <-errc
+	}
+	select {
+	case <-ready:
+		started <- nil
+		return <-errc
+	case err := <-errc:
+		started <- err
+		return err
+	}
+}
+
+// readyWatcher forwards ssh's stdout and stderr to command.Trace, and
+// closes ready the first time it sees tunnelReadyLine across either
+// stream.
+type readyWatcher struct {
+	mu    sync.Mutex
+	ready chan struct{}
+	once  sync.Once
+	buf   []byte
+}
+
+func (w *readyWatcher) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := command.Trace.Write(p); err != nil {
+		return 0, err
+	}
+	w.buf = append(w.buf, p...)
+	if bytes.Contains(w.buf, []byte(tunnelReadyLine)) {
+		w.once.Do(func() { close(w.ready) })
+	}
+	return len(p), nil
+}
+
+// freeLocalPort asks the OS for an unused TCP port.
+func freeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}